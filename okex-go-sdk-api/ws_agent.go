@@ -11,7 +11,6 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/signal"
 	"runtime/debug"
@@ -28,6 +27,7 @@ type OKWSAgent struct {
 	baseUrl string
 	config  *Config
 	conn    *websocket.Conn
+	connMut sync.RWMutex
 
 	wsEvtCh  chan interface{}
 	wsErrCh  chan interface{}
@@ -35,28 +35,37 @@ type OKWSAgent struct {
 	stopCh   chan interface{}
 	signalCh chan os.Signal
 
-	callback       ReceivedDataCallback
-	activeChannels map[string]bool
-	hotDepthsMap   map[string]*WSHotDepths
+	callback          ReceivedDataCallback
+	activeChannels    map[string]bool
+	activeChannelsMut sync.RWMutex
+	hotDepthsMap      map[string]*WSHotDepths
+	hotDepthsMut      sync.RWMutex
 
-	processMut sync.Mutex
-}
+	subscriptions map[string][]*Subscription
+	subMut        sync.RWMutex
 
-func (a *OKWSAgent) Start(config *Config) error {
-	a.baseUrl = config.WSEndpoint + "ws/v3?compress=true"
-	if config.IsPrint {
-		log.Printf("Connecting to %s", a.baseUrl)
-	}
+	subscribeQueue chan *pendingSubscribe
+	writeBucket    *tokenBucket
+	inFlight       []*pendingSubscribe
+	lastOpPendings []*pendingSubscribe
+	pendingMut     sync.Mutex
 
-	c, _, err := websocket.DefaultDialer.Dial(a.baseUrl, nil)
+	state ConnectionState
 
-	if err != nil {
-		log.Fatalf("dial:%+v", err)
-		return err
-	}
+	logger  Logger
+	metrics Metrics
 
-	a.conn = c
+	lastMsgAt   time.Time
+	lastPingAt  time.Time
+	lastPingRTT time.Duration
+	statsMut    sync.RWMutex
+
+	processMut sync.Mutex
+}
+
+func (a *OKWSAgent) Start(config *Config) error {
 	a.config = config
+	a.baseUrl = config.WSEndpoint + "ws/v3?compress=true"
 
 	a.wsEvtCh = make(chan interface{})
 	a.wsErrCh = make(chan interface{})
@@ -65,39 +74,129 @@ func (a *OKWSAgent) Start(config *Config) error {
 	a.signalCh = make(chan os.Signal)
 	a.activeChannels = make(map[string]bool)
 	a.hotDepthsMap = make(map[string]*WSHotDepths)
+	a.subscriptions = make(map[string][]*Subscription)
+	a.subscribeQueue = make(chan *pendingSubscribe, 1024)
+	a.writeBucket = newTokenBucket(config.SubscribeOpsPerSec)
 	a.callback = config.Callback
 
+	a.logger = config.Logger
+	if a.logger == nil {
+		a.logger = DefaultLogger
+	}
+	a.metrics = config.Metrics
+	if a.metrics == nil {
+		a.metrics = NoopMetrics
+	}
+
+	if err := a.connect(); err != nil {
+		return err
+	}
+
 	signal.Notify(a.signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	go a.work()
 	go a.receive()
 	go a.finalize()
+	go a.subscribeWriter()
 
 	return nil
 }
 
-func (a *OKWSAgent) Subscribe(channel, filter string) error {
-	a.processMut.Lock()
-	defer a.processMut.Unlock()
+// connect dials the WebSocket endpoint, updating the agent's ConnectionState
+// along the way. It is used both by Start and by the reconnect loop after a
+// disconnect.
+func (a *OKWSAgent) connect() error {
+	a.setState(StateConnecting)
+	a.logger.Info("ws: connecting", F("url", a.baseUrl))
 
-	st := SubscriptionTopic{channel, filter}
-	bo, err := subscribeOp([]*SubscriptionTopic{&st})
+	c, _, err := websocket.DefaultDialer.Dial(a.baseUrl, nil)
 	if err != nil {
-		return err
+		a.setState(StateDisconnected)
+		return errors.Wrap(err, "dial")
 	}
 
-	msg, err := Struct2JsonString(bo)
-	if a.config.IsPrint {
-		log.Printf("Send Msg: %s", msg)
-	}
-	if err := a.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
-		return err
-	}
+	a.setConn(c)
+	a.setState(StateConnected)
+
+	// Seed lastMsgAt on every successful dial so the idle watchdog measures
+	// time since this connection came up. Left unseeded, LastMessageAge
+	// reports 0 and the watchdog would never trip on a connection that dies
+	// before receiving a single frame; a stale timestamp left over from
+	// before a reconnect would trip it immediately after a slow redial.
+	a.recordMessageReceived()
 
 	return nil
 }
 
+// getConn and setConn guard a.conn with connMut: connect() (running on the
+// receive() goroutine) reassigns it on every (re)dial while work() reads it
+// concurrently from ping(), writeMessage(), and forceClose().
+func (a *OKWSAgent) getConn() *websocket.Conn {
+	a.connMut.RLock()
+	defer a.connMut.RUnlock()
+	return a.conn
+}
+
+func (a *OKWSAgent) setConn(c *websocket.Conn) {
+	a.connMut.Lock()
+	a.conn = c
+	a.connMut.Unlock()
+}
+
+func (a *OKWSAgent) setState(s ConnectionState) {
+	a.statsMut.Lock()
+	a.state = s
+	a.statsMut.Unlock()
+
+	if a.config.ConnectionStateCallback != nil {
+		a.config.ConnectionStateCallback(s)
+	}
+}
+
+func (a *OKWSAgent) getState() ConnectionState {
+	a.statsMut.RLock()
+	defer a.statsMut.RUnlock()
+	return a.state
+}
+
+// Subscribe subscribes to a single channel/filter pair and returns a
+// Subscription handle carrying the typed events decoded for it. It blocks
+// until the subscribe is acknowledged; see SubscribeAsync to not block, and
+// SubscribeMany to subscribe to many topics in batched ops.
+func (a *OKWSAgent) Subscribe(channel, filter string) (*Subscription, error) {
+	return a.SubscribeAsync(channel, filter).Wait()
+}
+
+// SubscribeMany subscribes to many topics and returns a single Subscription
+// handle spanning all of them once every one is acknowledged.
+func (a *OKWSAgent) SubscribeMany(topics []SubscriptionTopic) (*Subscription, error) {
+	return a.SubscribeManyAsync(topics).Wait()
+}
+
+// SubscribeAsync queues channel/filter to be written by the rate-limited
+// subscribeWriter and returns a SubscribeFuture that resolves once the
+// server acknowledges it (or reports an error).
+func (a *OKWSAgent) SubscribeAsync(channel, filter string) *SubscribeFuture {
+	return a.SubscribeManyAsync([]SubscriptionTopic{NewSubscriptionTopic(channel, filter)})
+}
+
+// SubscribeManyAsync is the batch form of SubscribeAsync. Calls issued
+// within the same Config.SubscribeCoalesceWindow are packed by
+// subscribeWriter into as few BaseOps as Config.MaxArgsPerOp allows, cutting
+// round trips for callers subscribing to many instruments at once.
+func (a *OKWSAgent) SubscribeManyAsync(topics []SubscriptionTopic) *SubscribeFuture {
+	p := &pendingSubscribe{
+		topics:    topics,
+		remaining: int32(len(topics)),
+		future:    &SubscribeFuture{done: make(chan struct{})},
+	}
+	a.subscribeQueue <- p
+	return p.future
+}
+
 func (a *OKWSAgent) UnSubscribe(channel, filter string) error {
+	a.writeBucket.take()
+
 	a.processMut.Lock()
 	defer a.processMut.Unlock()
 
@@ -108,14 +207,22 @@ func (a *OKWSAgent) UnSubscribe(channel, filter string) error {
 	}
 
 	msg, err := Struct2JsonString(bo)
-	if a.config.IsPrint {
-		log.Printf("Send Msg: %s", msg)
+	a.logger.Debug("ws: send message", F("msg", msg))
+	if err := a.writeMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		return err
 	}
-	if err := a.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+
+	// activeChannels is keyed by the full "channel:filter" topic string (see
+	// handleEventResponse/resume), so it must be cleared with the same key
+	// it was set with, not just channel.
+	topic, err := st.ToString()
+	if err != nil {
 		return err
 	}
 
-	a.activeChannels[channel] = false
+	a.activeChannelsMut.Lock()
+	a.activeChannels[topic] = false
+	a.activeChannelsMut.Unlock()
 
 	return nil
 }
@@ -130,8 +237,8 @@ func (a *OKWSAgent) Login(apiKey, passphrase string) error {
 	} else {
 		op, err := loginOp(apiKey, passphrase, timestamp, sign)
 		data, err := Struct2JsonString(op)
-		log.Printf("Send Msg: %s", data)
-		err = a.conn.WriteMessage(websocket.TextMessage, []byte(data))
+		a.logger.Debug("ws: send message", F("msg", data))
+		err = a.writeMessage(websocket.TextMessage, []byte(data))
 		if err != nil {
 			return err
 		}
@@ -146,8 +253,8 @@ func (a *OKWSAgent) keepalive() error {
 
 func (a *OKWSAgent) Stop() error {
 	defer func() {
-		if a := recover(); a != nil {
-			log.Printf("Stop End. Recover msg: %+v", a)
+		if r := recover(); r != nil {
+			a.logger.Error("ws: stop recovered", F("panic", r))
 		}
 	}()
 
@@ -161,19 +268,15 @@ func (a *OKWSAgent) Stop() error {
 }
 
 func (a *OKWSAgent) finalize() error {
-	defer func() {
-		if a.config.IsPrint {
-			log.Printf("Finalize End. Connection to WebSocket is closed.")
-		}
-	}()
+	defer a.logger.Info("ws: finalize end, connection closed")
 
 	select {
 	case <-a.stopCh:
-		if a.conn != nil {
+		if conn := a.getConn(); conn != nil {
 			close(a.wsTbCh)
 			close(a.wsEvtCh)
 			close(a.wsErrCh)
-			return a.conn.Close()
+			return conn.Close()
 		}
 	}
 
@@ -182,14 +285,27 @@ func (a *OKWSAgent) finalize() error {
 
 func (a *OKWSAgent) ping() error {
 	msg := "ping"
-	//log.Printf("Send Msg: %s", msg)
-	if err := a.conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+	if err := a.writeMessage(websocket.TextMessage, []byte(msg)); err != nil {
 		return errors.Wrap(err, "write ping message")
 	}
 
+	a.statsMut.Lock()
+	a.lastPingAt = time.Now()
+	a.statsMut.Unlock()
+
 	return nil
 }
 
+// writeMessage writes to the socket, applying Config.WriteTimeout as a write
+// deadline when one is configured.
+func (a *OKWSAgent) writeMessage(messageType int, data []byte) error {
+	conn := a.getConn()
+	if a.config.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(a.config.WriteTimeout))
+	}
+	return conn.WriteMessage(messageType, data)
+}
+
 var readerPool = sync.Pool{
 	New: func() interface{} {
 		return flate.NewReader(bytes.NewReader([]byte{}))
@@ -212,7 +328,15 @@ func (a *OKWSAgent) handleErrResponse(r interface{}) error {
 		return nil
 	}
 
-	log.Printf("handleErrResponse %+v \n", r)
+	a.logger.Warn("ws: handleErrResponse", F("response", r))
+
+	// WSErrorResponse carries no channel to correlate against, so a server
+	// error is attributed to the pendingSubscribes from the op we most
+	// recently sent rather than every subscribe still awaiting acknowledgement.
+	if er, ok := r.(*WSErrorResponse); ok && er.ErrorCode >= 30000 {
+		a.failLastOpSubscribes(errors.Errorf("server error %d: %s", er.ErrorCode, er.Message))
+	}
+
 	return nil
 }
 
@@ -222,13 +346,26 @@ func (a *OKWSAgent) handleEventResponse(r interface{}) error {
 	}
 
 	er := r.(*WSEventResponse)
+	a.activeChannelsMut.Lock()
 	a.activeChannels[er.Channel] = (er.Event == CHNL_EVENT_SUBSCRIBE)
+	a.activeChannelsMut.Unlock()
+	a.metrics.IncChannelEvent(er.Channel)
+
+	if er.Event == CHNL_EVENT_SUBSCRIBE {
+		a.ackPendingSubscribe(er.Channel)
+	}
+
 	return nil
 }
 
 func (a *OKWSAgent) handleTableResponse(r interface{}) error {
+	a.dispatchSubscriptions(r)
+
 	if a.callback != nil {
-		if err := a.callback(r); err != nil {
+		start := time.Now()
+		err := a.callback(r)
+		a.metrics.ObserveCallbackLatency(time.Since(start))
+		if err != nil {
 			return err
 		}
 	}
@@ -237,20 +374,29 @@ func (a *OKWSAgent) handleTableResponse(r interface{}) error {
 
 func (a *OKWSAgent) work() {
 	defer func() {
-		if a := recover(); a != nil {
-			log.Printf("Work End. Recover msg: %+v", a)
-			debug.PrintStack()
+		if r := recover(); r != nil {
+			a.logger.Error("ws: work end recovered", F("panic", r), F("stack", string(debug.Stack())))
 		}
 	}()
 
 	defer a.Stop()
 
-	ticker := time.NewTicker(14 * time.Second)
+	pingInterval := a.config.PingInterval
+	if pingInterval <= 0 {
+		pingInterval = 14 * time.Second
+	}
+
+	ticker := time.NewTicker(pingInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
+			if a.readIdleTimedOut() {
+				a.logger.Warn("ws: read idle timeout exceeded, forcing reconnect", F("age", a.LastMessageAge()))
+				a.forceClose()
+				continue
+			}
 			if err := a.keepalive(); err != nil {
 				DefaultDataCallBack(err)
 			}
@@ -270,19 +416,25 @@ func (a *OKWSAgent) work() {
 
 func (a *OKWSAgent) receive() {
 	defer func() {
-		if a := recover(); a != nil {
-			log.Printf("Receive End. Recover msg: %+v", a)
-			debug.PrintStack()
+		if r := recover(); r != nil {
+			a.logger.Error("ws: receive end recovered", F("panic", r), F("stack", string(debug.Stack())))
 		}
 	}()
 
 	for {
-		messageType, message, err := a.conn.ReadMessage()
+		messageType, message, err := a.getConn().ReadMessage()
 		if err != nil {
 			DefaultDataCallBack(err)
+			a.logger.Error("ws: read error", F("err", err))
+			if a.reconnect() {
+				continue
+			}
 			break
 		}
 
+		a.metrics.IncMessagesReceived()
+		a.recordMessageReceived()
+
 		txtMsg := message
 		switch messageType {
 		case websocket.TextMessage:
@@ -292,16 +444,15 @@ func (a *OKWSAgent) receive() {
 				DefaultDataCallBack(err)
 				break
 			}
+			a.metrics.AddBytesDecompressed(len(txtMsg))
 
 		}
 
 		rsp, err := loadResponse(txtMsg)
 		if rsp != nil {
-			if a.config.IsPrint {
-				log.Printf("LoadedRep: %+v, err: %+v", rsp, err)
-			}
+			a.logger.Debug("ws: loaded response", F("response", rsp), F("err", err))
 		} else {
-			log.Printf("TextMsg: %s", txtMsg)
+			a.logger.Warn("ws: unrecognized message", F("msg", string(txtMsg)))
 		}
 
 		if err != nil {
@@ -309,6 +460,11 @@ func (a *OKWSAgent) receive() {
 		}
 
 		switch v := rsp.(type) {
+		case string:
+			if v == "pong" {
+				a.recordPong()
+			}
+
 		case *WSErrorResponse:
 			if v != nil {
 				a.wsErrCh <- rsp
@@ -322,6 +478,7 @@ func (a *OKWSAgent) receive() {
 		case *WSDepthTableResponse:
 			var err error
 			dtr := rsp.(*WSDepthTableResponse)
+			a.hotDepthsMut.Lock()
 			hotDepths := a.hotDepthsMap[dtr.Table]
 			if hotDepths == nil {
 				hotDepths = NewWSHotDepths(dtr.Table)
@@ -332,11 +489,14 @@ func (a *OKWSAgent) receive() {
 			} else {
 				err = hotDepths.loadWSDepthTableResponse(dtr)
 			}
+			a.hotDepthsMut.Unlock()
 
 			if err == nil {
+				a.notifyDepthUpdate(hotDepths, dtr)
 				a.wsTbCh <- dtr
 			} else {
-				log.Printf("Failed to loadWSDepthTableResponse, dtr: %+v, err: %+v", dtr, err)
+				a.metrics.IncChecksumFailures()
+				a.logger.Error("ws: loadWSDepthTableResponse failed", F("table", dtr.Table), F("err", err))
 			}
 
 		case *WSTableResponse:
@@ -14,6 +14,7 @@ import (
 	"hash/crc32"
 	"strconv"
 	"strings"
+	"sync"
 
 	rbt "github.com/emirpasic/gods/trees/redblacktree"
 )
@@ -74,6 +75,12 @@ type SubscriptionTopic struct {
 	filter  string `default:""`
 }
 
+// NewSubscriptionTopic builds a SubscriptionTopic for Subscribe/SubscribeMany.
+// filter may be empty for channels that don't take one.
+func NewSubscriptionTopic(channel, filter string) SubscriptionTopic {
+	return SubscriptionTopic{channel: channel, filter: filter}
+}
+
 func (st *SubscriptionTopic) ToString() (topic string, err error) {
 	if len(st.channel) == 0 {
 		return "", ERR_WS_SUBSCRIOTION_PARAMS
@@ -253,6 +260,8 @@ func (r *WSDepthTableResponse) Valid() bool {
 type WSHotDepths struct {
 	Table    string
 	DepthMap map[string]*WSDepthItem
+
+	mu sync.RWMutex
 }
 
 func NewWSHotDepths(tb string) *WSHotDepths {
@@ -263,6 +272,9 @@ func NewWSHotDepths(tb string) *WSHotDepths {
 }
 
 func (d *WSHotDepths) loadWSDepthTableResponse(r *WSDepthTableResponse) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if d.Table != r.Table {
 		return fmt.Errorf("Loading WSDepthTableResponse failed becoz of "+
 			"WSTableResponse(%s) not matched with WSHotDepths(%s)", r.Table, d.Table)
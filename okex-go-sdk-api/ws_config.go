@@ -0,0 +1,82 @@
+package okex
+
+import "time"
+
+// Config carries the settings OKWSAgent needs to establish and maintain a
+// WebSocket connection to the OKEx v3 API.
+type Config struct {
+	WSEndpoint string
+	ApiKey     string
+	SecretKey  string
+	Passphrase string
+	Callback   ReceivedDataCallback
+
+	// Logger and Metrics default to DefaultLogger and NoopMetrics
+	// respectively when left nil.
+	Logger  Logger
+	Metrics Metrics
+
+	// PingInterval is how often a "ping" keepalive frame is sent. ReadIdleTimeout
+	// is the longest the agent will wait without receiving any inbound frame
+	// before force-closing the connection to trigger a reconnect. WriteTimeout
+	// bounds how long a write to the socket may block. All three default to
+	// 14s/30s/0 (no deadline) respectively when left zero.
+	PingInterval    time.Duration
+	ReadIdleTimeout time.Duration
+	WriteTimeout    time.Duration
+
+	// ReconnectMinDelay and ReconnectMaxDelay bound the exponential backoff
+	// used between redial attempts after a disconnect. ReconnectMaxAttempts
+	// limits how many times the agent will redial before giving up; zero or
+	// negative means retry forever.
+	ReconnectMinDelay    time.Duration
+	ReconnectMaxDelay    time.Duration
+	ReconnectMaxAttempts int
+
+	// SubscribeOpsPerSec caps how many subscribe/unsubscribe ops per second
+	// are written to the socket, honoring OKEx's per-connection quota.
+	// MaxArgsPerOp bounds how many topics are packed into a single BaseOp's
+	// "args" array. SubscribeCoalesceWindow is how long pending Subscribe
+	// calls are buffered so concurrent calls can be coalesced into one op.
+	// They default to 5/sec, 50, and 50ms respectively when left zero.
+	SubscribeOpsPerSec      float64
+	MaxArgsPerOp            int
+	SubscribeCoalesceWindow time.Duration
+
+	// ConnectionStateCallback, if set, is notified whenever the agent's
+	// connection transitions between Connecting/Connected/Reconnecting/
+	// Disconnected.
+	ConnectionStateCallback ConnectionStateCallback
+
+	// DepthUpdateCallback, if set, is notified after every depth update is
+	// merged into the cached order book, with the diff and post-merge
+	// top-of-book for the instrument it touched.
+	DepthUpdateCallback DepthUpdateCallback
+}
+
+// ConnectionState describes the lifecycle of the WebSocket connection
+// managed by OKWSAgent.
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnecting
+	StateConnected
+	StateReconnecting
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "Connecting"
+	case StateConnected:
+		return "Connected"
+	case StateReconnecting:
+		return "Reconnecting"
+	default:
+		return "Disconnected"
+	}
+}
+
+// ConnectionStateCallback is notified of ConnectionState transitions.
+type ConnectionStateCallback func(ConnectionState)
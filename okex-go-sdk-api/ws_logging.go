@@ -0,0 +1,87 @@
+package okex
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// KV is a single structured logging field.
+type KV struct {
+	Key   string
+	Value interface{}
+}
+
+// F builds a KV field for a Logger call.
+func F(key string, value interface{}) KV {
+	return KV{Key: key, Value: value}
+}
+
+// Logger is the structured logging hook used throughout OKWSAgent. Config
+// defaults to DefaultLogger (stdlib log.Println) when left nil.
+type Logger interface {
+	Debug(msg string, fields ...KV)
+	Info(msg string, fields ...KV)
+	Warn(msg string, fields ...KV)
+	Error(msg string, fields ...KV)
+}
+
+// DefaultLogger logs through the standard library's log package.
+var DefaultLogger Logger = stdLogger{}
+
+// NoopLogger discards everything logged to it.
+var NoopLogger Logger = noopLogger{}
+
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, fields ...KV) { stdLog("DEBUG", msg, fields) }
+func (stdLogger) Info(msg string, fields ...KV)  { stdLog("INFO", msg, fields) }
+func (stdLogger) Warn(msg string, fields ...KV)  { stdLog("WARN", msg, fields) }
+func (stdLogger) Error(msg string, fields ...KV) { stdLog("ERROR", msg, fields) }
+
+func stdLog(level, msg string, fields []KV) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteString(" ")
+		b.WriteString(f.Key)
+		b.WriteString("=")
+		b.WriteString(fmt.Sprintf("%v", f.Value))
+	}
+	log.Println(b.String())
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debug(string, ...KV) {}
+func (noopLogger) Info(string, ...KV)  {}
+func (noopLogger) Warn(string, ...KV)  {}
+func (noopLogger) Error(string, ...KV) {}
+
+// Metrics reports counters and histograms for an OKWSAgent instance. Config
+// defaults to NoopMetrics when left nil.
+type Metrics interface {
+	IncMessagesReceived()
+	AddBytesDecompressed(n int)
+	IncChecksumFailures()
+	IncReconnects()
+	ObservePingRTT(d time.Duration)
+	IncChannelEvent(channel string)
+	ObserveCallbackLatency(d time.Duration)
+}
+
+// NoopMetrics discards everything reported to it.
+var NoopMetrics Metrics = noopMetrics{}
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncMessagesReceived()                 {}
+func (noopMetrics) AddBytesDecompressed(int)             {}
+func (noopMetrics) IncChecksumFailures()                 {}
+func (noopMetrics) IncReconnects()                       {}
+func (noopMetrics) ObservePingRTT(time.Duration)         {}
+func (noopMetrics) IncChannelEvent(string)               {}
+func (noopMetrics) ObserveCallbackLatency(time.Duration) {}
@@ -0,0 +1,137 @@
+package okex
+
+import (
+	"fmt"
+	"strconv"
+
+	rbt "github.com/emirpasic/gods/trees/redblacktree"
+)
+
+// PriceLevel is one row of an order book snapshot.
+type PriceLevel struct {
+	Price  float64
+	Size   float64
+	Orders int64
+}
+
+// OrderBookSnapshot is an immutable copy of the top-N bids/asks cached for
+// an instrument, safe to read after GetOrderBook returns it or
+// DepthUpdateCallback receives it.
+type OrderBookSnapshot struct {
+	Table        string
+	InstrumentId string
+	Bids         []PriceLevel
+	Asks         []PriceLevel
+	Timestamp    string
+	Checksum     int32
+}
+
+// DepthUpdateCallback fires after a depth update has been merged into the
+// cached order book, with the raw diff that was applied and the resulting
+// top-of-book for the instrument it touched.
+type DepthUpdateCallback func(instrumentID string, diff *WsDepthUpdates, top *OrderBookSnapshot)
+
+// GetOrderBook returns an immutable copy of the top-N bids/asks cached for
+// instrumentID on table, guarded by WSHotDepths' RWMutex. depth <= 0 returns
+// every cached price level.
+func (a *OKWSAgent) GetOrderBook(table, instrumentID string, depth int) (*OrderBookSnapshot, error) {
+	a.hotDepthsMut.RLock()
+	hd := a.hotDepthsMap[table]
+	a.hotDepthsMut.RUnlock()
+
+	if hd == nil {
+		return nil, fmt.Errorf("no depth data cached for table %s", table)
+	}
+
+	return hd.snapshot(instrumentID, depth)
+}
+
+// GetBestBidAsk searches every table the agent has cached depth for and
+// returns the top-of-book bid and ask from the first one holding
+// instrumentID. Which table is used when several hold it is not defined.
+func (a *OKWSAgent) GetBestBidAsk(instrumentID string) (bid, ask PriceLevel, err error) {
+	a.hotDepthsMut.RLock()
+	defer a.hotDepthsMut.RUnlock()
+
+	for _, hd := range a.hotDepthsMap {
+		if bid, ask, ok := hd.bestBidAsk(instrumentID); ok {
+			return bid, ask, nil
+		}
+	}
+
+	return PriceLevel{}, PriceLevel{}, fmt.Errorf("no depth data cached for instrument %s", instrumentID)
+}
+
+// notifyDepthUpdate invokes Config.DepthUpdateCallback, if set, once per
+// instrument touched by dtr with the diff that was applied and the
+// post-merge top-of-book.
+func (a *OKWSAgent) notifyDepthUpdate(hd *WSHotDepths, dtr *WSDepthTableResponse) {
+	if a.config.DepthUpdateCallback == nil {
+		return
+	}
+
+	for i := range dtr.Data {
+		diff := dtr.Data[i]
+		top, err := hd.snapshot(diff.InstrumentId, 1)
+		if err != nil {
+			continue
+		}
+		a.config.DepthUpdateCallback(diff.InstrumentId, &diff, top)
+	}
+}
+
+func (d *WSHotDepths) snapshot(instrumentID string, depth int) (*OrderBookSnapshot, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	item := d.DepthMap[instrumentID]
+	if item == nil {
+		return nil, fmt.Errorf("no depth data cached for instrument %s", instrumentID)
+	}
+
+	return &OrderBookSnapshot{
+		Table:        d.Table,
+		InstrumentId: item.InstrumentId,
+		Bids:         topPriceLevels(item.Bids, depth),
+		Asks:         topPriceLevels(item.Asks, depth),
+		Timestamp:    item.Timestamp,
+		Checksum:     item.Checksum,
+	}, nil
+}
+
+func (d *WSHotDepths) bestBidAsk(instrumentID string) (bid, ask PriceLevel, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	item := d.DepthMap[instrumentID]
+	if item == nil || item.Bids.Size() == 0 || item.Asks.Size() == 0 {
+		return PriceLevel{}, PriceLevel{}, false
+	}
+
+	return toPriceLevel(item.Bids.Left().Value.([4]interface{})),
+		toPriceLevel(item.Asks.Left().Value.([4]interface{})), true
+}
+
+func topPriceLevels(t *rbt.Tree, depth int) []PriceLevel {
+	size := t.Size()
+	if depth <= 0 || depth > size {
+		depth = size
+	}
+
+	levels := make([]PriceLevel, 0, depth)
+	iter := t.Iterator()
+	for i := 0; i < depth; i++ {
+		iter.Next()
+		levels = append(levels, toPriceLevel(iter.Value().([4]interface{})))
+	}
+
+	return levels
+}
+
+func toPriceLevel(raw [4]interface{}) PriceLevel {
+	price, _ := strconv.ParseFloat(raw[0].(string), 64)
+	size, _ := strconv.ParseFloat(raw[1].(string), 64)
+	orders := StringToInt64(raw[3].(string))
+
+	return PriceLevel{Price: price, Size: size, Orders: orders}
+}
@@ -0,0 +1,104 @@
+package okex
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// reconnect tears down the current connection and redials with exponential
+// backoff and jitter, honoring Config's Reconnect* settings, then replays
+// the login and every active subscription so callers observe an
+// uninterrupted stream. It reports whether the agent is connected and ready
+// for receive() to resume reading.
+func (a *OKWSAgent) reconnect() bool {
+	if conn := a.getConn(); conn != nil {
+		conn.Close()
+	}
+
+	a.metrics.IncReconnects()
+	a.setState(StateReconnecting)
+	a.failPendingSubscribes(errors.New("connection lost before subscribe was acknowledged"))
+
+	minDelay := a.config.ReconnectMinDelay
+	if minDelay <= 0 {
+		minDelay = time.Second
+	}
+	maxDelay := a.config.ReconnectMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	maxAttempts := a.config.ReconnectMaxAttempts
+
+	delay := minDelay
+	for attempt := 1; maxAttempts <= 0 || attempt <= maxAttempts; attempt++ {
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+
+		if err := a.connect(); err != nil {
+			a.logger.Warn("ws: reconnect attempt failed", F("attempt", attempt), F("err", err))
+			delay *= 2
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+			continue
+		}
+
+		if err := a.resume(); err != nil {
+			a.logger.Warn("ws: resume after reconnect failed", F("attempt", attempt), F("err", err))
+			delay *= 2
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+			continue
+		}
+
+		return true
+	}
+
+	a.setState(StateDisconnected)
+	return false
+}
+
+// resume re-authenticates (if credentials were supplied) and replays every
+// channel tracked in activeChannels after a successful redial. It also
+// flushes hotDepthsMap so the next "partial" depth snapshot rebuilds each
+// order book's trees from scratch instead of merging into stale state.
+//
+// Replay uses SubscribeAsync rather than Subscribe: resume runs on the
+// receive() goroutine (via reconnect), and the ack that resolves a blocking
+// Subscribe only arrives through wsEvtCh, which is itself fed by that same
+// receive() loop. Waiting here would deadlock the agent on its first
+// reconnect with any active subscription.
+func (a *OKWSAgent) resume() error {
+	a.hotDepthsMut.Lock()
+	a.hotDepthsMap = make(map[string]*WSHotDepths)
+	a.hotDepthsMut.Unlock()
+
+	if len(a.config.ApiKey) > 0 {
+		if err := a.Login(a.config.ApiKey, a.config.Passphrase); err != nil {
+			return errors.Wrap(err, "re-login after reconnect")
+		}
+	}
+
+	a.activeChannelsMut.RLock()
+	topics := make([]string, 0, len(a.activeChannels))
+	for topic, active := range a.activeChannels {
+		if active {
+			topics = append(topics, topic)
+		}
+	}
+	a.activeChannelsMut.RUnlock()
+
+	for _, topic := range topics {
+		channel, filter := topic, ""
+		if idx := strings.Index(topic, ":"); idx >= 0 {
+			channel, filter = topic[:idx], topic[idx+1:]
+		}
+
+		a.SubscribeAsync(channel, filter)
+	}
+
+	return nil
+}
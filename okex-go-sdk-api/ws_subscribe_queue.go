@@ -0,0 +1,303 @@
+package okex
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SubscribeFuture is returned by SubscribeAsync/SubscribeManyAsync and
+// resolves once every topic it covers has been acknowledged by the server,
+// or the server reports an error while it's pending.
+type SubscribeFuture struct {
+	done chan struct{}
+	sub  *Subscription
+	err  error
+}
+
+// Wait blocks until the subscribe is acknowledged and returns its handle.
+func (f *SubscribeFuture) Wait() (*Subscription, error) {
+	<-f.done
+	return f.sub, f.err
+}
+
+func (f *SubscribeFuture) resolve(sub *Subscription, err error) {
+	f.sub, f.err = sub, err
+	close(f.done)
+}
+
+// pendingSubscribe is one SubscribeAsync/SubscribeManyAsync call waiting to
+// be written and then acknowledged. remaining counts how many of its topics
+// haven't yet been echoed back by a CHNL_EVENT_SUBSCRIBE event. Its topics
+// may be split across more than one BaseOp by flushSubscribeBatch when they
+// don't all fit under Config.MaxArgsPerOp; remaining still tracks the whole
+// set regardless of how many ops they were sent in.
+type pendingSubscribe struct {
+	topics    []SubscriptionTopic
+	remaining int32
+	future    *SubscribeFuture
+}
+
+// subscribeWriter drains a.subscribeQueue, coalescing everything queued
+// within a Config.SubscribeCoalesceWindow into as few BaseOps as
+// Config.MaxArgsPerOp allows, and paces writes through a.writeBucket so a
+// caller subscribing to hundreds of instruments can't trip OKEx's
+// per-connection rate limit.
+func (a *OKWSAgent) subscribeWriter() {
+	window := a.config.SubscribeCoalesceWindow
+	if window <= 0 {
+		window = 50 * time.Millisecond
+	}
+
+	for {
+		var batch []*pendingSubscribe
+
+		select {
+		case <-a.stopCh:
+			return
+		case p, ok := <-a.subscribeQueue:
+			if !ok {
+				return
+			}
+			batch = append(batch, p)
+		}
+
+		timer := time.NewTimer(window)
+	drain:
+		for {
+			select {
+			case p, ok := <-a.subscribeQueue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, p)
+			case <-timer.C:
+				break drain
+			case <-a.stopCh:
+				timer.Stop()
+				return
+			}
+		}
+		timer.Stop()
+
+		a.flushSubscribeBatch(batch)
+	}
+}
+
+func (a *OKWSAgent) flushSubscribeBatch(batch []*pendingSubscribe) {
+	maxArgs := a.config.MaxArgsPerOp
+	if maxArgs <= 0 {
+		maxArgs = 50
+	}
+
+	a.pendingMut.Lock()
+	a.inFlight = append(a.inFlight, batch...)
+	a.pendingMut.Unlock()
+
+	var chunk []*SubscriptionTopic
+	var chunkPendings []*pendingSubscribe
+	inChunk := make(map[*pendingSubscribe]bool)
+
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		a.sendSubscribeOp(chunk, chunkPendings)
+		chunk = nil
+		chunkPendings = nil
+		inChunk = make(map[*pendingSubscribe]bool)
+	}
+
+	for _, p := range batch {
+		for i := range p.topics {
+			if len(chunk) >= maxArgs {
+				flush()
+			}
+			chunk = append(chunk, &p.topics[i])
+			if !inChunk[p] {
+				inChunk[p] = true
+				chunkPendings = append(chunkPendings, p)
+			}
+		}
+	}
+	flush()
+}
+
+// sendSubscribeOp writes a single subscribe BaseOp for sts. pendings is
+// every pendingSubscribe that contributed a topic to sts; on a successful
+// write it becomes the target of the next failLastOpSubscribes call, so a
+// server error responding to this op doesn't have to be blamed on every
+// other pendingSubscribe still in flight.
+func (a *OKWSAgent) sendSubscribeOp(sts []*SubscriptionTopic, pendings []*pendingSubscribe) {
+	a.writeBucket.take()
+
+	a.processMut.Lock()
+	bo, err := subscribeOp(sts)
+	if err != nil {
+		a.processMut.Unlock()
+		a.failPendingTopics(sts, err)
+		return
+	}
+
+	msg, err := Struct2JsonString(bo)
+	a.logger.Debug("ws: send message", F("msg", msg))
+	writeErr := a.writeMessage(websocket.TextMessage, []byte(msg))
+	a.processMut.Unlock()
+
+	if writeErr != nil {
+		a.failPendingTopics(sts, writeErr)
+		return
+	}
+
+	a.pendingMut.Lock()
+	a.lastOpPendings = pendings
+	a.pendingMut.Unlock()
+}
+
+// ackPendingSubscribe resolves every in-flight pendingSubscribe once all of
+// its topics have been echoed back by the matching channel.
+func (a *OKWSAgent) ackPendingSubscribe(channel string) {
+	a.pendingMut.Lock()
+	defer a.pendingMut.Unlock()
+
+	remaining := a.inFlight[:0]
+	for _, p := range a.inFlight {
+		if topicsContain(p.topics, channel) {
+			p.remaining--
+		}
+
+		if p.remaining <= 0 {
+			sub := newSubscription(a, p.topics)
+			a.addSubscription(sub)
+			p.future.resolve(sub, nil)
+		} else {
+			remaining = append(remaining, p)
+		}
+	}
+	a.inFlight = remaining
+}
+
+// failPendingTopics resolves every in-flight pendingSubscribe that overlaps
+// sts with err, used when writing the op itself failed.
+func (a *OKWSAgent) failPendingTopics(sts []*SubscriptionTopic, err error) {
+	keys := make(map[string]bool, len(sts))
+	for _, st := range sts {
+		key, _ := st.ToString()
+		keys[key] = true
+	}
+
+	a.pendingMut.Lock()
+	defer a.pendingMut.Unlock()
+
+	remaining := a.inFlight[:0]
+	for _, p := range a.inFlight {
+		if pendingMatchesKeys(p, keys) {
+			p.future.resolve(nil, err)
+		} else {
+			remaining = append(remaining, p)
+		}
+	}
+	a.inFlight = remaining
+}
+
+// failPendingSubscribes resolves every currently in-flight pendingSubscribe
+// with err, used when the connection itself is lost and none of them can
+// ever be acknowledged (see reconnect).
+func (a *OKWSAgent) failPendingSubscribes(err error) {
+	a.pendingMut.Lock()
+	defer a.pendingMut.Unlock()
+
+	for _, p := range a.inFlight {
+		p.future.resolve(nil, err)
+	}
+	a.inFlight = nil
+	a.lastOpPendings = nil
+}
+
+// failLastOpSubscribes resolves only the pendingSubscribes that were part
+// of the most recently sent subscribe op, used when a server error arrives
+// with no channel to correlate it against (see handleErrResponse). Other
+// still-pending subscribes from earlier, unrelated ops are left alone.
+func (a *OKWSAgent) failLastOpSubscribes(err error) {
+	a.pendingMut.Lock()
+	defer a.pendingMut.Unlock()
+
+	if len(a.lastOpPendings) == 0 {
+		return
+	}
+	target := make(map[*pendingSubscribe]bool, len(a.lastOpPendings))
+	for _, p := range a.lastOpPendings {
+		target[p] = true
+	}
+	a.lastOpPendings = nil
+
+	remaining := a.inFlight[:0]
+	for _, p := range a.inFlight {
+		if target[p] {
+			p.future.resolve(nil, err)
+		} else {
+			remaining = append(remaining, p)
+		}
+	}
+	a.inFlight = remaining
+}
+
+func topicsContain(topics []SubscriptionTopic, channel string) bool {
+	for _, t := range topics {
+		key, _ := t.ToString()
+		if key == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func pendingMatchesKeys(p *pendingSubscribe, keys map[string]bool) bool {
+	for _, t := range p.topics {
+		key, _ := t.ToString()
+		if keys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenBucket paces writes to honor Config.SubscribeOpsPerSec.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	rate     float64
+	last     time.Time
+}
+
+func newTokenBucket(opsPerSec float64) *tokenBucket {
+	if opsPerSec <= 0 {
+		opsPerSec = 5
+	}
+	return &tokenBucket{tokens: opsPerSec, capacity: opsPerSec, rate: opsPerSec, last: time.Now()}
+}
+
+// take blocks until a token is available, refilling at b.rate tokens/sec.
+func (b *tokenBucket) take() {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return
+		}
+
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,244 @@
+package okex
+
+import (
+	"strings"
+	"sync"
+)
+
+// subscriptionBufSize is the default capacity of a Subscription's Events
+// channel. Events beyond it are dropped rather than blocking the receive
+// goroutine.
+const subscriptionBufSize = 256
+
+// DepthEvent is delivered on a Subscription's Events channel for any "depth"
+// table.
+type DepthEvent struct {
+	Table  string
+	Action string
+	Data   []WsDepthUpdates
+}
+
+// TickerEvent is delivered on a Subscription's Events channel for any
+// "ticker" table.
+type TickerEvent struct {
+	Table string
+	Data  []interface{}
+}
+
+// TradeEvent is delivered on a Subscription's Events channel for any "trade"
+// table.
+type TradeEvent struct {
+	Table string
+	Data  []interface{}
+}
+
+// OrderEvent is delivered on a Subscription's Events channel for any "order"
+// table.
+type OrderEvent struct {
+	Table string
+	Data  []interface{}
+}
+
+// Subscription is the handle returned by Subscribe/SubscribeMany. Events is
+// fed typed events (DepthEvent, TickerEvent, TradeEvent, OrderEvent)
+// decoded from the raw table responses for the topics it was created with.
+type Subscription struct {
+	Topics []SubscriptionTopic
+	Events chan interface{}
+
+	agent  *OKWSAgent
+	mu     sync.Mutex
+	closed bool
+}
+
+func newSubscription(agent *OKWSAgent, topics []SubscriptionTopic) *Subscription {
+	return &Subscription{
+		Topics: topics,
+		Events: make(chan interface{}, subscriptionBufSize),
+		agent:  agent,
+	}
+}
+
+// Close unsubscribes every topic backing this handle and closes its Events
+// channel, draining anything left buffered. It is safe to call more than
+// once. UnSubscribe clears activeChannels under the same channel:filter key
+// it was set with, so a closed Subscription stays closed across a reconnect
+// rather than being silently resumed by resume().
+func (s *Subscription) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	var firstErr error
+	for _, t := range s.Topics {
+		if err := s.agent.UnSubscribe(t.channel, t.filter); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	s.agent.removeSubscription(s)
+	close(s.Events)
+	for range s.Events {
+	}
+
+	return firstErr
+}
+
+func (s *Subscription) deliver(event interface{}) {
+	select {
+	case s.Events <- event:
+	default:
+	}
+}
+
+func (a *OKWSAgent) addSubscription(sub *Subscription) {
+	a.subMut.Lock()
+	defer a.subMut.Unlock()
+
+	for _, t := range sub.Topics {
+		key, _ := t.ToString()
+		a.subscriptions[key] = append(a.subscriptions[key], sub)
+	}
+}
+
+func (a *OKWSAgent) removeSubscription(sub *Subscription) {
+	a.subMut.Lock()
+	defer a.subMut.Unlock()
+
+	for _, t := range sub.Topics {
+		key, _ := t.ToString()
+		subs := a.subscriptions[key]
+		for i, s := range subs {
+			if s == sub {
+				a.subscriptions[key] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// dispatchSubscriptions decodes a raw table response into its typed event
+// and delivers it to every Subscription registered for the topic it came
+// from. A topic matches the response's table only at a channel boundary
+// (exact equality, or up to a trailing ":filter"), and each subscription
+// only receives the Data entries for the instrument(s) its own filter
+// scopes it to.
+func (a *OKWSAgent) dispatchSubscriptions(r interface{}) {
+	var table string
+	switch v := r.(type) {
+	case *WSDepthTableResponse:
+		table = v.Table
+	case *WSTableResponse:
+		table = v.Table
+	default:
+		return
+	}
+
+	a.subMut.RLock()
+	defer a.subMut.RUnlock()
+
+	for topic, subs := range a.subscriptions {
+		channel, filter := splitTopic(topic)
+		if channel != table {
+			continue
+		}
+
+		event := buildFilteredEvent(r, filter)
+		if event == nil {
+			continue
+		}
+
+		for _, s := range subs {
+			s.deliver(event)
+		}
+	}
+}
+
+// splitTopic splits a subscriptions map key, produced by
+// SubscriptionTopic.ToString, back into its channel and filter parts.
+func splitTopic(topic string) (channel, filter string) {
+	if idx := strings.Index(topic, ":"); idx >= 0 {
+		return topic[:idx], topic[idx+1:]
+	}
+	return topic, ""
+}
+
+// buildFilteredEvent decodes r into its typed event, scoping Data to the
+// entries matching filter (an empty filter matches everything). It returns
+// nil if nothing in r matches filter.
+func buildFilteredEvent(r interface{}, filter string) interface{} {
+	switch v := r.(type) {
+	case *WSDepthTableResponse:
+		data := filterDepthData(v.Data, filter)
+		if len(data) == 0 {
+			return nil
+		}
+		return &DepthEvent{Table: v.Table, Action: v.Action, Data: data}
+	case *WSTableResponse:
+		data := filterGenericData(v.Data, filter)
+		if len(data) == 0 {
+			return nil
+		}
+		return decodeTableEvent(&WSTableResponse{Table: v.Table, Action: v.Action, Data: data})
+	default:
+		return nil
+	}
+}
+
+func filterDepthData(data []WsDepthUpdates, filter string) []WsDepthUpdates {
+	if filter == "" {
+		return data
+	}
+
+	filtered := make([]WsDepthUpdates, 0, len(data))
+	for _, d := range data {
+		if d.InstrumentId == filter {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+func filterGenericData(data []interface{}, filter string) []interface{} {
+	if filter == "" {
+		return data
+	}
+
+	filtered := make([]interface{}, 0, len(data))
+	for _, d := range data {
+		if instrumentID(d) == filter {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// instrumentID extracts the "instrument_id" field from a decoded table
+// Data entry, which loadResponse leaves as a map[string]interface{}.
+func instrumentID(d interface{}) string {
+	m, ok := d.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	id, _ := m["instrument_id"].(string)
+	return id
+}
+
+// decodeTableEvent uses the table name as a discriminator to decode a
+// generic WSTableResponse into one of the typed events.
+func decodeTableEvent(r *WSTableResponse) interface{} {
+	switch {
+	case strings.Contains(r.Table, "ticker"):
+		return &TickerEvent{Table: r.Table, Data: r.Data}
+	case strings.Contains(r.Table, "trade"):
+		return &TradeEvent{Table: r.Table, Data: r.Data}
+	case strings.Contains(r.Table, "order"):
+		return &OrderEvent{Table: r.Table, Data: r.Data}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package okex
+
+import "time"
+
+// ConnectionStatus is a point-in-time snapshot of an OKWSAgent's connection
+// health, returned by Status.
+type ConnectionStatus struct {
+	State          ConnectionState
+	LastMessageAge time.Duration
+	PingRTT        time.Duration
+}
+
+// Status reports the agent's current ConnectionState, the time since the
+// last inbound frame of any kind, and the most recently measured ping RTT.
+func (a *OKWSAgent) Status() ConnectionStatus {
+	return ConnectionStatus{
+		State:          a.getState(),
+		LastMessageAge: a.LastMessageAge(),
+		PingRTT:        a.lastPingRTT,
+	}
+}
+
+// LastMessageAge is how long it's been since any inbound frame (message or
+// pong) was last seen on the connection.
+func (a *OKWSAgent) LastMessageAge() time.Duration {
+	a.statsMut.RLock()
+	defer a.statsMut.RUnlock()
+
+	if a.lastMsgAt.IsZero() {
+		return 0
+	}
+	return time.Since(a.lastMsgAt)
+}
+
+func (a *OKWSAgent) recordMessageReceived() {
+	a.statsMut.Lock()
+	a.lastMsgAt = time.Now()
+	a.statsMut.Unlock()
+}
+
+func (a *OKWSAgent) recordPong() {
+	a.statsMut.Lock()
+	if a.lastPingAt.IsZero() {
+		a.statsMut.Unlock()
+		return
+	}
+	rtt := time.Since(a.lastPingAt)
+	a.lastPingRTT = rtt
+	a.statsMut.Unlock()
+
+	a.metrics.ObservePingRTT(rtt)
+}
+
+// readIdleTimedOut reports whether longer than Config.ReadIdleTimeout (30s
+// default) has passed since the last inbound frame.
+func (a *OKWSAgent) readIdleTimedOut() bool {
+	timeout := a.config.ReadIdleTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return a.LastMessageAge() > timeout
+}
+
+// forceClose closes the underlying connection so the blocked ReadMessage in
+// receive() errors out and the reconnect path takes over.
+func (a *OKWSAgent) forceClose() {
+	if conn := a.getConn(); conn != nil {
+		conn.Close()
+	}
+}